@@ -0,0 +1,195 @@
+// Copyright 2018 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/lunixbochs/vtclean"
+)
+
+// Builder builds a static site checked out at src into dst.
+type Builder interface {
+	// Name identifies the builder, e.g. for logging and for the
+	// build cache manifest.
+	Name() string
+	// Detect reports whether repoDir looks like a site this builder
+	// knows how to build.
+	Detect(repoDir string) bool
+	// Build builds the site rooted at src into dst.
+	Build(ctx context.Context, src, dst string) error
+}
+
+// jekyllBuilder builds sites with `jekyll build`.
+type jekyllBuilder struct {
+	safe bool
+}
+
+func (jekyllBuilder) Name() string { return "jekyll" }
+
+func (jekyllBuilder) Detect(repoDir string) bool {
+	return fileExists(filepath.Join(repoDir, "_config.yml"))
+}
+
+func (b jekyllBuilder) Build(ctx context.Context, src, dst string) error {
+	var safeFlag string
+	if b.safe {
+		safeFlag = "--safe"
+	}
+
+	cmd := exec.CommandContext(ctx, "jekyll", "build", safeFlag, "-s", src, "-d", dst)
+	cmd.Dir = src
+	return runBuildCommand(cmd)
+}
+
+// hugoBuilder builds sites with `hugo`.
+type hugoBuilder struct{}
+
+func (hugoBuilder) Name() string { return "hugo" }
+
+func (hugoBuilder) Detect(repoDir string) bool {
+	for _, name := range [...]string{"config.toml", "hugo.toml", "config.yaml", "config.yml", "config.json"} {
+		if fileExists(filepath.Join(repoDir, name)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (hugoBuilder) Build(ctx context.Context, src, dst string) error {
+	cmd := exec.CommandContext(ctx, "hugo", "--source", src, "--destination", dst)
+	cmd.Dir = src
+	return runBuildCommand(cmd)
+}
+
+// eleventyBuilder builds sites with Eleventy, run via `npx
+// @11ty/eleventy`.
+type eleventyBuilder struct{}
+
+func (eleventyBuilder) Name() string { return "eleventy" }
+
+func (eleventyBuilder) Detect(repoDir string) bool {
+	return fileExists(filepath.Join(repoDir, ".eleventy.js"))
+}
+
+func (eleventyBuilder) Build(ctx context.Context, src, dst string) error {
+	cmd := exec.CommandContext(ctx, "npx", "@11ty/eleventy", "--input="+src, "--output="+dst)
+	cmd.Dir = src
+	return runBuildCommand(cmd)
+}
+
+// passthroughBuilder serves a repo's files as-is, for repos with no
+// static site generator. It always detects, so it must be tried
+// last.
+type passthroughBuilder struct{}
+
+func (passthroughBuilder) Name() string { return "static" }
+
+func (passthroughBuilder) Detect(repoDir string) bool { return true }
+
+func (passthroughBuilder) Build(ctx context.Context, src, dst string) error {
+	return copyTree(src, dst)
+}
+
+// commandBuilder runs an arbitrary shell command to build a site,
+// set via --builder-cmd. $SRC and $DST are exported for the command
+// to read.
+type commandBuilder struct {
+	cmd string
+}
+
+func (commandBuilder) Name() string { return "command" }
+
+func (commandBuilder) Detect(repoDir string) bool { return true }
+
+func (b commandBuilder) Build(ctx context.Context, src, dst string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", b.cmd)
+	cmd.Dir = src
+	cmd.Env = append(os.Environ(), "SRC="+src, "DST="+dst)
+	return runBuildCommand(cmd)
+}
+
+// runBuildCommand runs cmd, capturing stderr into a stderrError on
+// failure, the same way the rest of jekyll-history reports build
+// failures.
+func runBuildCommand(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	stderrClean := vtclean.NewWriter(&stderr, false)
+
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderrClean)
+
+	err := cmd.Run()
+	stderrClean.Close()
+
+	if err != nil {
+		return &stderrError{err, stderr.Bytes()}
+	}
+
+	return nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// copyTree recursively copies the regular files and directories
+// under src into dst.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if filepath.Base(p) == ".git" {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+
+		return copyFile(p, target, info.Mode())
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,310 @@
+// Copyright 2018 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// negativeCacheTTL is how long a failed build is remembered before
+// the next request is allowed to retry it.
+const negativeCacheTTL = 5 * time.Minute
+
+// cacheEntry is the persisted record of a single commit's build,
+// stored in the buildCache's manifest.json.
+type cacheEntry struct {
+	Commit     string    `json:"commit"`
+	Builder    string    `json:"builder,omitempty"`
+	BuiltAt    time.Time `json:"built_at"`
+	LastServed time.Time `json:"last_served"`
+	Bytes      int64     `json:"bytes"`
+	ExitCode   int       `json:"exit_code"`
+	Stderr     string    `json:"stderr,omitempty"`
+}
+
+func (e *cacheEntry) success() bool {
+	return e.ExitCode == 0
+}
+
+// buildCache persists built sites to a stable directory, keyed by
+// commit SHA, so that a restart doesn't force every commit to be
+// rebuilt from scratch. It enforces an LRU eviction policy bounded by
+// maxBytes and maxEntries, evicting the least-recently-served commit.
+type buildCache struct {
+	dir        string
+	maxBytes   int64
+	maxEntries int
+
+	// onEvict, if set, is called instead of remove whenever evictLRU
+	// picks a commit to evict, so that the caller can also release
+	// the commit's SafeHostSwitch host and ch.build/liveReload
+	// entries rather than just the cached directory.
+	onEvict func(commit string)
+
+	mu         sync.Mutex
+	entries    map[string]*cacheEntry
+	totalBytes int64
+}
+
+// newBuildCache opens (creating if necessary) a buildCache rooted at
+// dir, loading any existing manifest.json.
+func newBuildCache(dir string, maxBytes int64, maxEntries int) (*buildCache, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	c := &buildCache{
+		dir:        dir,
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*cacheEntry),
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// defaultCacheDir returns the default --cache-dir for repo, rooted
+// under $XDG_CACHE_HOME (or the platform equivalent).
+func defaultCacheDir(repo string) string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+
+	h := fnv.New64a()
+	io.WriteString(h, repo)
+
+	return filepath.Join(base, "jekyll-history", hex.EncodeToString(h.Sum(nil)))
+}
+
+func (c *buildCache) manifestPath() string {
+	return filepath.Join(c.dir, "manifest.json")
+}
+
+// dirFor returns the on-disk directory a commit's built site is, or
+// would be, stored in.
+func (c *buildCache) dirFor(commit string) string {
+	return filepath.Join(c.dir, commit)
+}
+
+func (c *buildCache) load() error {
+	data, err := ioutil.ReadFile(c.manifestPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries []*cacheEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		c.entries[e.Commit] = e
+		c.totalBytes += e.Bytes
+	}
+
+	return nil
+}
+
+// save persists the manifest to disk. c.mu must be held.
+func (c *buildCache) save() error {
+	entries := make([]*cacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	tmp := c.manifestPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0666); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.manifestPath())
+}
+
+// get returns the cache entry for commit, if any usable record
+// exists: either a successful build, or a failed build that hasn't
+// yet passed its negative-cache TTL. It does not update LastServed;
+// callers that actually serve the entry should call touch.
+func (c *buildCache) get(commit string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[commit]
+	if !ok {
+		return nil, false
+	}
+
+	if !e.success() && time.Since(e.BuiltAt) > negativeCacheTTL {
+		return nil, false
+	}
+
+	return e, true
+}
+
+// touch updates commit's LastServed time for LRU purposes.
+func (c *buildCache) touch(commit string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[commit]; ok {
+		e.LastServed = time.Now()
+
+		if err := c.save(); err != nil {
+			log.Printf("buildCache: failed to save manifest: %v", err)
+		}
+	}
+}
+
+// record stores the outcome of building commit with the named
+// builder into dir, replacing any previous entry. It does not enforce
+// the LRU eviction policy; that is left to evictLRU.
+func (c *buildCache) record(commit, dir, builder string, buildErr error) {
+	e := &cacheEntry{
+		Commit:     commit,
+		Builder:    builder,
+		BuiltAt:    time.Now(),
+		LastServed: time.Now(),
+		ExitCode:   exitCode(buildErr),
+	}
+
+	if se, ok := buildErr.(*stderrError); ok {
+		e.Stderr = string(se.stderr)
+	}
+
+	e.Bytes = dirSize(dir)
+
+	c.mu.Lock()
+	if old, ok := c.entries[commit]; ok {
+		c.totalBytes -= old.Bytes
+	}
+
+	c.entries[commit] = e
+	c.totalBytes += e.Bytes
+
+	if err := c.save(); err != nil {
+		log.Printf("buildCache: failed to save manifest: %v", err)
+	}
+	c.mu.Unlock()
+}
+
+// remove deletes commit's entry and on-disk directory, if any.
+func (c *buildCache) remove(commit string) {
+	c.mu.Lock()
+	if e, ok := c.entries[commit]; ok {
+		c.totalBytes -= e.Bytes
+		delete(c.entries, commit)
+
+		if err := c.save(); err != nil {
+			log.Printf("buildCache: failed to save manifest: %v", err)
+		}
+	}
+	c.mu.Unlock()
+
+	os.RemoveAll(c.dirFor(commit))
+}
+
+// entriesSnapshot returns the cached commits as of now, used to
+// hydrate a commitHandler on startup.
+func (c *buildCache) entriesSnapshot() []*cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries := make([]*cacheEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+// evictLRU removes the least-recently-served commits until the cache
+// is back under its configured limits.
+func (c *buildCache) evictLRU() {
+	for {
+		c.mu.Lock()
+
+		over := (c.maxBytes > 0 && c.totalBytes > c.maxBytes) ||
+			(c.maxEntries > 0 && len(c.entries) > c.maxEntries)
+		if !over {
+			c.mu.Unlock()
+			return
+		}
+
+		var oldest *cacheEntry
+		for _, e := range c.entries {
+			if oldest == nil || e.LastServed.Before(oldest.LastServed) {
+				oldest = e
+			}
+		}
+
+		c.mu.Unlock()
+
+		if oldest == nil {
+			return
+		}
+
+		if c.onEvict != nil {
+			c.onEvict(oldest.Commit)
+		} else {
+			c.remove(oldest.Commit)
+		}
+	}
+}
+
+// exitCode extracts the process exit code from a build error, or
+// 0 for a nil error and -1 if it can't be determined.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if se, ok := err.(*stderrError); ok {
+		err = se.err
+	}
+
+	if ee, ok := err.(*exec.ExitError); ok {
+		return ee.ExitCode()
+	}
+
+	return -1
+}
+
+// dirSize returns the total size in bytes of the regular files under
+// dir, or 0 if it can't be determined.
+func dirSize(dir string) int64 {
+	var size int64
+
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size
+}
@@ -9,6 +9,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"hash/fnv"
@@ -22,7 +23,8 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"path"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,22 +33,9 @@ import (
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
-	"github.com/lunixbochs/vtclean"
 	"github.com/tmthrgd/httphandlers"
 )
 
-var indexTmpl = template.Must(template.New("index").Parse(`<!doctype html>
-<meta charset=utf-8>
-<title>{{.Title}}</title>
-<style>body{margin:40px auto;max-width:650px;line-height:1.6;font-size:18px;color:#444;padding:0 10px}h1,h2,h3{line-height:1.2}</style>
-<h1>{{.Title}}</h1>
-<p>{{len .Commits}} commits:</p>
-<ul>
-{{- range .OrderedCommits}}
-<li><a href="/commit/{{.}}/"><code>{{.}}</code> {{index $.Commits .}}</a></li>
-{{- end}}
-</ul>`))
-
 var error404 = `<!doctype html>
 <meta charset=utf-8>
 <title>404 Not Found</title>
@@ -80,6 +69,30 @@ func main() {
 	var port int
 	flag.IntVar(&port, "port", 8080, "the port to listen on")
 
+	var pollInterval time.Duration
+	flag.DurationVar(&pollInterval, "poll-interval", 5*time.Minute, "how often to git fetch and refresh the commit list")
+
+	var webhookSecret string
+	flag.StringVar(&webhookSecret, "webhook-secret", "", "if set, the HMAC secret required to trigger an immediate refresh via POST /__refresh")
+
+	var cacheDir string
+	flag.StringVar(&cacheDir, "cache-dir", "", "directory to persist built sites in (default $XDG_CACHE_HOME/jekyll-history/<repo-hash>)")
+
+	var cacheMaxBytes int64
+	flag.Int64Var(&cacheMaxBytes, "cache-max-bytes", 0, "evict least-recently-served commits once the cache exceeds this size (0 means unbounded)")
+
+	var cacheMaxEntries int
+	flag.IntVar(&cacheMaxEntries, "cache-max-entries", 0, "evict least-recently-served commits once the cache holds more than this many (0 means unbounded)")
+
+	var builderName string
+	flag.StringVar(&builderName, "builder", "", "force a specific builder instead of auto-detecting one (jekyll, hugo, eleventy, static)")
+
+	var builderCmd string
+	flag.StringVar(&builderCmd, "builder-cmd", "", "force building with an arbitrary shell command, run with $SRC and $DST set")
+
+	var buildConcurrency int
+	flag.IntVar(&buildConcurrency, "build-concurrency", runtime.NumCPU(), "how many commits to build at once")
+
 	flag.Parse()
 
 	repo := flag.Arg(0)
@@ -89,10 +102,8 @@ func main() {
 		os.Exit(1)
 	}
 
-	for _, name := range [...]string{"git", "jekyll"} {
-		if _, err := exec.LookPath(name); err != nil {
-			log.Fatal(err)
-		}
+	if _, err := exec.LookPath("git"); err != nil {
+		log.Fatal(err)
 	}
 
 	repoDir, err := ioutil.TempDir("", "repo.")
@@ -102,13 +113,15 @@ func main() {
 
 	defer os.RemoveAll(repoDir)
 
-	outDir, err := ioutil.TempDir("", "site.")
+	if cacheDir == "" {
+		cacheDir = defaultCacheDir(repo)
+	}
+
+	cache, err := newBuildCache(cacheDir, cacheMaxBytes, cacheMaxEntries)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer os.RemoveAll(outDir)
-
 	cmd := exec.Command("git", "clone", repo, repoDir)
 	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
 
@@ -158,32 +171,60 @@ func main() {
 
 	now := time.Now()
 
-	index, err := handlers.ServeTemplate("index.html", now, indexTmpl, struct {
-		Title          string
-		OrderedCommits []string
-		Commits        map[string]string
-	}{
-		Title:          repo,
-		OrderedCommits: orderedCommits,
-		Commits:        commits,
-	})
-	if err != nil {
-		log.Fatal(err)
+	siteBuilders := []Builder{
+		jekyllBuilder{safe: safe},
+		hugoBuilder{},
+		eleventyBuilder{},
+		passthroughBuilder{},
 	}
 
-	router.Get("/", index.ServeHTTP)
-	router.Get("/commit/{commit}/*", (&commitHandler{
-		safe:     safe,
-		port:     port,
-		repoDir:  repoDir,
-		outDir:   outDir,
-		commits:  commits,
-		hosts:    hosts,
-		notFound: notFoundHandler,
+	var forcedBuilder Builder
+
+	switch {
+	case builderCmd != "":
+		forcedBuilder = commandBuilder{cmd: builderCmd}
+	case builderName != "":
+		for _, b := range siteBuilders {
+			if b.Name() == builderName {
+				forcedBuilder = b
+				break
+			}
+		}
+
+		if forcedBuilder == nil {
+			log.Fatalf("unknown -builder %q", builderName)
+		}
+	}
+
+	ch := &commitHandler{
+		port:          port,
+		repoDir:       repoDir,
+		cache:         cache,
+		index:         newCommitIndex(orderedCommits, commits),
+		hosts:         hosts,
+		notFound:      notFoundHandler,
+		builders:      siteBuilders,
+		forcedBuilder: forcedBuilder,
+	}
+	ch.pool = newBuildPool(ch, buildConcurrency)
+	ch.cache.onEvict = ch.evict
+	ch.hydrate()
+
+	router.Get("/", (&indexHandler{
+		title: repo,
+		ch:    ch,
 	}).ServeHTTP)
+	router.Get("/commit/{commit}/*", ch.ServeHTTP)
 	router.Get("/favicon.ico", handlers.ServeString("favicon.png", now, favicon).ServeHTTP)
 	router.Get("/robots.txt", handlers.ServeString("robots.txt", now, robots).ServeHTTP)
 
+	rw := &repoWatcher{interval: pollInterval, ch: ch}
+	go rw.run()
+
+	if webhookSecret != "" {
+		router.Post("/__refresh", (&refreshHandler{rw: rw, secret: webhookSecret}).ServeHTTP)
+	}
+
 	handler := handlers.AccessLog(hosts, nil)
 	handler = &handlers.SecurityHeaders{
 		Handler: handler,
@@ -218,59 +259,127 @@ func main() {
 }
 
 type commitHandler struct {
-	safe     bool
 	port     int
 	repoDir  string
-	outDir   string
-	commits  map[string]string
+	cache    *buildCache
 	hosts    *handlers.SafeHostSwitch
 	notFound http.Handler
 
-	build    sync.Map
-	repoLock sync.Mutex
+	builders      []Builder // tried in order; passthroughBuilder should be last
+	forcedBuilder Builder   // non-nil if --builder or --builder-cmd was set
+	pool          *buildPool
+
+	mu    sync.RWMutex
+	index *commitIndex // guarded by mu; refreshed by repoWatcher
+
+	build      sync.Map
+	liveReload sync.Map // commit -> *LiveReloadHandler
+
+	// worktreeLock serializes only the git plumbing that mutates
+	// shared repo state (fetch, worktree add/remove); the builds
+	// themselves run concurrently in their own worktrees.
+	worktreeLock sync.Mutex
 }
 
-func (ch *commitHandler) buildSite(commit, dir string) error {
-	var stderr bytes.Buffer
-	stderrClean := vtclean.NewWriter(&stderr, false)
-	stderrWriter := io.MultiWriter(os.Stderr, stderrClean)
+// currentIndex returns the commit index currently being served. It
+// may be concurrently replaced by a repoWatcher refresh.
+func (ch *commitHandler) currentIndex() *commitIndex {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
 
-	ch.repoLock.Lock()
-	defer ch.repoLock.Unlock()
+	return ch.index
+}
+
+// lookupCommit looks up commit in the current commit index.
+func (ch *commitHandler) lookupCommit(commit string) (commitInfo, bool) {
+	return ch.currentIndex().lookup(commit)
+}
+
+// selectBuilder picks the Builder to use for the commit checked out
+// at repoDir: the forced builder if one was configured via
+// --builder/--builder-cmd, otherwise the first of ch.builders whose
+// Detect reports true.
+func (ch *commitHandler) selectBuilder(repoDir string) (Builder, error) {
+	if ch.forcedBuilder != nil {
+		return ch.forcedBuilder, nil
+	}
+
+	for _, b := range ch.builders {
+		if b.Detect(repoDir) {
+			return b, nil
+		}
+	}
+
+	return nil, errors.New("no builder detected for this repo")
+}
+
+// worktreeDir returns the scratch git worktree path used to build
+// commit.
+func (ch *commitHandler) worktreeDir(commit string) string {
+	return filepath.Join(ch.cache.dir, ".worktrees", commit)
+}
 
-	cmd := exec.Command("git", "checkout", commit)
+// addWorktree and removeWorktree touch ch.repoDir's shared metadata,
+// so they're serialized by ch.worktreeLock, as is repoWatcher's fetch;
+// the build itself runs unlocked.
+func (ch *commitHandler) addWorktree(commit, dir string) error {
+	ch.worktreeLock.Lock()
+	defer ch.worktreeLock.Unlock()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "worktree", "add", "--detach", dir, commit)
 	cmd.Dir = ch.repoDir
-	cmd.Stdout, cmd.Stderr = os.Stdout, stderrWriter
+	cmd.Stdout, cmd.Stderr = os.Stdout, &stderr
 
 	if err := cmd.Run(); err != nil {
-		stderrClean.Close()
 		return &stderrError{err, stderr.Bytes()}
 	}
 
-	stderr.Reset()
+	return nil
+}
 
-	var safeFlag string
-	if ch.safe {
-		safeFlag = "--safe"
-	}
+func (ch *commitHandler) removeWorktree(dir string) {
+	ch.worktreeLock.Lock()
+	defer ch.worktreeLock.Unlock()
 
-	cmd = exec.Command("jekyll", "build", safeFlag, "-s", ch.repoDir, "-d", dir)
+	cmd := exec.Command("git", "worktree", "remove", "--force", dir)
 	cmd.Dir = ch.repoDir
-	cmd.Stdout, cmd.Stderr = os.Stdout, stderrWriter
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
 
 	if err := cmd.Run(); err != nil {
-		stderrClean.Close()
-		return &stderrError{err, stderr.Bytes()}
+		log.Printf("failed to remove worktree %s: %v", dir, err)
 	}
+}
 
-	return nil
+// buildInWorktree builds commit into dir using a scratch git
+// worktree, so that it can run concurrently with builds of other
+// commits. It returns the name of the Builder used.
+func (ch *commitHandler) buildInWorktree(commit, dir string) (string, error) {
+	worktree := ch.worktreeDir(commit)
+
+	if err := ch.addWorktree(commit, worktree); err != nil {
+		return "", err
+	}
+
+	defer ch.removeWorktree(worktree)
+
+	b, err := ch.selectBuilder(worktree)
+	if err != nil {
+		return "", err
+	}
+
+	if err := b.Build(context.Background(), worktree, dir); err != nil {
+		return b.Name(), err
+	}
+
+	return b.Name(), nil
 }
 
 func (ch *commitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	params := chi.RouteContext(r.Context())
 	commit, redirect := params.URLParam("commit"), params.URLParam("*")
 
-	if _, ok := ch.commits[commit]; !ok {
+	if _, ok := ch.lookupCommit(commit); !ok {
 		ch.notFound.ServeHTTP(w, r)
 		return
 	}
@@ -281,6 +390,10 @@ func (ch *commitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	host, err := v.(*buildCommitOnce).Do(ch, commit)
+	if err == nil {
+		ch.cache.touch(commit)
+		ch.cache.evictLRU()
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 
@@ -308,46 +421,108 @@ func (ch *commitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url.String(), http.StatusSeeOther)
 }
 
+// buildCommitOnce memoizes the outcome of building a single commit, so
+// that concurrent requests for the same unbuilt commit only trigger
+// one build. Unlike a sync.Once, a memoized failure is only held for
+// negativeCacheTTL: once it elapses, the next Do call retries the
+// build instead of replaying the same error forever.
 type buildCommitOnce struct {
-	once sync.Once
-	host string
-	err  error
+	mu      sync.Mutex
+	done    bool
+	builtAt time.Time
+	host    string
+	err     error
 }
 
 func (bc *buildCommitOnce) Do(ch *commitHandler, commit string) (string, error) {
-	bc.once.Do(func() {
-		dir := path.Join(ch.outDir, commit)
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if bc.done && (bc.err == nil || time.Since(bc.builtAt) <= negativeCacheTTL) {
+		return bc.host, bc.err
+	}
+
+	bc.host, bc.err = "", nil
+
+	dir := ch.cache.dirFor(commit)
+
+	if entry, ok := ch.cache.get(commit); ok {
+		if !entry.success() {
+			bc.err = &stderrError{errCachedBuildFailure, []byte(entry.Stderr)}
+		}
+	} else {
+		builderName, buildErr := ch.pool.build(commit, dir)
+		ch.cache.record(commit, dir, builderName, buildErr)
 
-		if bc.err = ch.buildSite(commit, dir); bc.err != nil {
-			return
+		if buildErr != nil {
+			bc.err = buildErr
 		}
+	}
 
-		handler := siteHandler(dir)
+	bc.builtAt = time.Now()
+	bc.done = true
 
-		var ip [net.IPv4len]byte
-		one := [1]byte{1}
+	if bc.err != nil {
+		return bc.host, bc.err
+	}
 
-		h := fnv.New32a()
-		io.WriteString(h, commit)
+	lr := NewLiveReloadHandler()
+	ch.liveReload.Store(commit, lr)
 
-		for {
-			h.Sum(ip[:0])
-			ip[0] = 127
+	bc.host = ch.allocateHost(commit, siteHandler(dir, lr))
 
-			bc.host = net.IP(ip[:]).String()
+	return bc.host, bc.err
+}
 
-			if ch.hosts.Add(bc.host, handler) == nil {
-				break
-			}
+// allocateHost mounts handler on the next free 127.x.x.x host,
+// derived deterministically from commit so the same commit tends to
+// get the same host across restarts.
+func (ch *commitHandler) allocateHost(commit string, handler http.Handler) string {
+	var ip [net.IPv4len]byte
+	one := [1]byte{1}
+
+	h := fnv.New32a()
+	io.WriteString(h, commit)
+
+	for {
+		h.Sum(ip[:0])
+		ip[0] = 127
 
-			h.Write(one[:])
+		host := net.IP(ip[:]).String()
+
+		if ch.hosts.Add(host, handler) == nil {
+			return host
 		}
-	})
 
-	return bc.host, bc.err
+		h.Write(one[:])
+	}
+}
+
+// hydrate mounts every successfully-built commit already present in
+// ch.cache's manifest that is also in the current commit index, so
+// that a restart serves them immediately
+// rather than rebuilding on first request.
+func (ch *commitHandler) hydrate() {
+	for _, e := range ch.cache.entriesSnapshot() {
+		if !e.success() {
+			continue
+		}
+
+		if _, ok := ch.lookupCommit(e.Commit); !ok {
+			continue
+		}
+
+		lr := NewLiveReloadHandler()
+		ch.liveReload.Store(e.Commit, lr)
+
+		bc := &buildCommitOnce{done: true, builtAt: time.Now()}
+		bc.host = ch.allocateHost(e.Commit, siteHandler(ch.cache.dirFor(e.Commit), lr))
+
+		ch.build.Store(e.Commit, bc)
+	}
 }
 
-func siteHandler(dir string) http.Handler {
+func siteHandler(dir string, lr *LiveReloadHandler) http.Handler {
 	notFound := handlers.ErrorCode(http.StatusNotFound)
 
 	if f, err := http.Dir(dir).Open("/404.html"); err == nil {
@@ -359,11 +534,23 @@ func siteHandler(dir string) http.Handler {
 	}
 
 	handler := http.FileServer(http.Dir(dir))
-	return handlers.StatusCodeSwitch(handler, map[int]http.Handler{
+	handler = injectLiveReload(handler)
+	handler = handlers.StatusCodeSwitch(handler, map[int]http.Handler{
 		http.StatusNotFound: notFound,
 	})
+
+	mux := http.NewServeMux()
+	mux.Handle(liveReloadPath, lr)
+	mux.Handle(liveReloadJSPath, lr)
+	mux.Handle("/", handler)
+	return mux
 }
 
+// errCachedBuildFailure is the underlying error reported for a commit
+// whose last build attempt is still remembered as a failure in the
+// buildCache.
+var errCachedBuildFailure = errors.New("previous build attempt failed")
+
 type stderrError struct {
 	err    error
 	stderr []byte
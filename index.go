@@ -0,0 +1,211 @@
+// Copyright 2018 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// commitsPerPage is the default number of commits rendered per index
+// page when the request doesn't specify ?n=.
+const commitsPerPage = 50
+
+// maxCommitsPerPage bounds ?n= so a client can't request a page size
+// large enough to overflow offset+n.
+const maxCommitsPerPage = 500
+
+var indexTmpl = template.Must(template.New("index").Parse(`<!doctype html>
+<meta charset=utf-8>
+<title>{{.Title}}</title>
+<style>body{margin:40px auto;max-width:650px;line-height:1.6;font-size:18px;color:#444;padding:0 10px}h1,h2,h3{line-height:1.2}form{margin:1em 0}</style>
+<h1>{{.Title}}</h1>
+<form action="/" method=get>
+<input type=text name=q value="{{.Query}}" placeholder="search commits" autofocus>
+<button type=submit>Search</button>
+</form>
+<p>{{.Total}} commit{{if ne .Total 1}}s{{end}}{{if .Query}} matching &ldquo;{{.Query}}&rdquo;{{end}}:</p>
+<ul>
+{{- range .Page}}
+<li><a href="/commit/{{.Hash}}/"><code>{{.Hash}}</code> {{.Title}}</a></li>
+{{- end}}
+</ul>
+{{template "pagination" .}}`))
+
+var _ = template.Must(indexTmpl.New("pagination").Parse(`<p>
+{{- if .HasPrev}}<a href="{{.PrevURL}}">&larr; prev</a>{{end}}
+{{- if and .HasPrev .HasNext}} | {{end}}
+{{- if .HasNext}}<a href="{{.NextURL}}">next &rarr;</a>{{end}}
+</p>`))
+
+// commitInfo is the metadata the index and search keep for a single
+// commit.
+type commitInfo struct {
+	Hash  string
+	Title string
+}
+
+// commitIndex holds the set of commits known to jekyll-history,
+// in git log order, along with a hash-sorted view that supports
+// prefix lookups for the search box.
+type commitIndex struct {
+	list   []commitInfo
+	byHash map[string]int
+	sorted []int // indices into list, sorted by Hash
+}
+
+// newCommitIndex builds a commitIndex from parallel orderedCommits/
+// commits data as produced by parsing `git log --oneline`.
+func newCommitIndex(orderedCommits []string, commits map[string]string) *commitIndex {
+	idx := &commitIndex{
+		list:   make([]commitInfo, len(orderedCommits)),
+		byHash: make(map[string]int, len(orderedCommits)),
+		sorted: make([]int, len(orderedCommits)),
+	}
+
+	for i, hash := range orderedCommits {
+		idx.list[i] = commitInfo{Hash: hash, Title: commits[hash]}
+		idx.byHash[hash] = i
+		idx.sorted[i] = i
+	}
+
+	sort.Slice(idx.sorted, func(i, j int) bool {
+		return idx.list[idx.sorted[i]].Hash < idx.list[idx.sorted[j]].Hash
+	})
+
+	return idx
+}
+
+// lookup returns the commitInfo for an exact commit hash.
+func (idx *commitIndex) lookup(hash string) (commitInfo, bool) {
+	i, ok := idx.byHash[hash]
+	if !ok {
+		return commitInfo{}, false
+	}
+
+	return idx.list[i], true
+}
+
+// search returns, in log order, every commit whose hash has prefix q
+// or whose title contains q as a substring. An empty q matches every
+// commit.
+func (idx *commitIndex) search(q string) []commitInfo {
+	if q == "" {
+		return idx.list
+	}
+
+	matches := make(map[string]bool)
+
+	lo := sort.Search(len(idx.sorted), func(i int) bool {
+		return idx.list[idx.sorted[i]].Hash >= q
+	})
+
+	for _, i := range idx.sorted[lo:] {
+		if !strings.HasPrefix(idx.list[i].Hash, q) {
+			break
+		}
+
+		matches[idx.list[i].Hash] = true
+	}
+
+	out := make([]commitInfo, 0, len(matches))
+
+	for _, c := range idx.list {
+		if matches[c.Hash] || strings.Contains(c.Title, q) {
+			out = append(out, c)
+		}
+	}
+
+	return out
+}
+
+// indexHandler serves the paginated, searchable commit index at /.
+type indexHandler struct {
+	title string
+	ch    *commitHandler
+}
+
+func (ih *indexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := q.Get("q")
+	results := ih.ch.currentIndex().search(query)
+
+	n, err := strconv.Atoi(q.Get("n"))
+	if err != nil || n <= 0 || n > maxCommitsPerPage {
+		n = commitsPerPage
+	}
+
+	offset, err := strconv.Atoi(q.Get("o"))
+	if err != nil || offset < 0 || offset > len(results) {
+		offset = 0
+	}
+
+	end := offset + n
+	if end > len(results) {
+		end = len(results)
+	}
+
+	data := struct {
+		Title   string
+		Query   string
+		Total   int
+		Page    []commitInfo
+		HasPrev bool
+		HasNext bool
+		PrevURL string
+		NextURL string
+	}{
+		Title: ih.title,
+		Query: query,
+		Total: len(results),
+		Page:  results[offset:end],
+	}
+
+	if offset > 0 {
+		data.HasPrev = true
+
+		prevOffset := offset - n
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+
+		data.PrevURL = indexPageURL(query, prevOffset, n)
+	}
+
+	if end < len(results) {
+		data.HasNext = true
+		data.NextURL = indexPageURL(query, end, n)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexTmpl.Execute(w, data)
+}
+
+func indexPageURL(query string, offset, n int) string {
+	v := make(url.Values)
+
+	if query != "" {
+		v.Set("q", query)
+	}
+
+	if offset != 0 {
+		v.Set("o", strconv.Itoa(offset))
+	}
+
+	if n != commitsPerPage {
+		v.Set("n", strconv.Itoa(n))
+	}
+
+	if len(v) == 0 {
+		return "/"
+	}
+
+	return "/?" + v.Encode()
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	liveReloadPath   = "/__livereload"
+	liveReloadJSPath = liveReloadPath + ".js"
+)
+
+const liveReloadScript = `(function() {
+	var proto = location.protocol === "https:" ? "wss:" : "ws:";
+	var ws = new WebSocket(proto + "//" + location.host + "` + liveReloadPath + `");
+	ws.onmessage = function(ev) {
+		if (ev.data === "reload") {
+			location.reload();
+		}
+	};
+})();`
+
+var liveReloadTag = []byte(`<script src="` + liveReloadJSPath + `"></script></body>`)
+
+var liveReloadUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// LiveReloadHandler serves the live-reload JS snippet and WebSocket
+// endpoint for a single per-commit host, and broadcasts a reload
+// notification to every browser currently connected to it.
+type LiveReloadHandler struct {
+	mu      sync.Mutex
+	clients map[*websocket.Conn]struct{}
+}
+
+// NewLiveReloadHandler returns a new, empty LiveReloadHandler.
+func NewLiveReloadHandler() *LiveReloadHandler {
+	return &LiveReloadHandler{
+		clients: make(map[*websocket.Conn]struct{}),
+	}
+}
+
+func (lr *LiveReloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == liveReloadJSPath {
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		io.WriteString(w, liveReloadScript)
+		return
+	}
+
+	conn, err := liveReloadUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("livereload: upgrade failed: %v", err)
+		return
+	}
+
+	lr.mu.Lock()
+	lr.clients[conn] = struct{}{}
+	lr.mu.Unlock()
+
+	defer func() {
+		lr.mu.Lock()
+		delete(lr.clients, conn)
+		lr.mu.Unlock()
+
+		conn.Close()
+	}()
+
+	// we don't expect any messages from the client, but we still need
+	// to read so that close frames and errors are observed promptly.
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+// Reload notifies every connected browser that it should reload the
+// page it's viewing.
+func (lr *LiveReloadHandler) Reload() {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	for conn := range lr.clients {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("reload")); err != nil {
+			conn.Close()
+			delete(lr.clients, conn)
+		}
+	}
+}
+
+// htmlRecorder buffers a response so that, if it turns out to be a
+// text/html document, injectLiveReload can splice a <script> tag in
+// before the closing </body> tag.
+type htmlRecorder struct {
+	http.ResponseWriter
+
+	buf         bytes.Buffer
+	status      int
+	injectable  bool
+	wroteHeader bool
+}
+
+func (rec *htmlRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.wroteHeader = true
+	rec.injectable = status == http.StatusOK &&
+		strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html")
+
+	if !rec.injectable {
+		rec.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (rec *htmlRecorder) Write(p []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+
+	if rec.injectable {
+		return rec.buf.Write(p)
+	}
+
+	return rec.ResponseWriter.Write(p)
+}
+
+func (rec *htmlRecorder) flush() {
+	if !rec.injectable {
+		return
+	}
+
+	body := rec.buf.Bytes()
+	if i := bytes.LastIndex(body, []byte("</body>")); i >= 0 {
+		rewritten := make([]byte, 0, len(body)+len(liveReloadTag))
+		rewritten = append(rewritten, body[:i]...)
+		rewritten = append(rewritten, liveReloadTag...)
+		rewritten = append(rewritten, body[i+len("</body>"):]...)
+		body = rewritten
+	}
+
+	rec.Header().Del("Content-Length")
+	rec.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rec.ResponseWriter.WriteHeader(rec.status)
+	rec.ResponseWriter.Write(body)
+}
+
+// injectLiveReload wraps handler so that any 200 OK text/html response
+// it produces has a live-reload <script> tag injected before </body>.
+// Responses with any other status are passed through unchanged.
+func injectLiveReload(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &htmlRecorder{ResponseWriter: w}
+		handler.ServeHTTP(rec, r)
+		rec.flush()
+	})
+}
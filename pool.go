@@ -0,0 +1,62 @@
+// Copyright 2018 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package main
+
+// buildJob is a single build request submitted to a buildPool.
+type buildJob struct {
+	commit string
+	dir    string
+	result chan buildResult
+}
+
+type buildResult struct {
+	builder string
+	err     error
+}
+
+// buildPool runs at most concurrency builds at once, each in its own
+// git worktree, so that several commits can be built in parallel
+// without fighting over ch.repoDir's working tree.
+type buildPool struct {
+	ch   *commitHandler
+	jobs chan *buildJob
+}
+
+// newBuildPool starts concurrency worker goroutines pulling jobs
+// submitted via build.
+func newBuildPool(ch *commitHandler, concurrency int) *buildPool {
+	p := &buildPool{
+		ch:   ch,
+		jobs: make(chan *buildJob),
+	}
+
+	for i := 0; i < concurrency; i++ {
+		go p.worker()
+	}
+
+	return p
+}
+
+func (p *buildPool) worker() {
+	for job := range p.jobs {
+		builder, err := p.ch.buildInWorktree(job.commit, job.dir)
+		job.result <- buildResult{builder, err}
+	}
+}
+
+// build submits commit/dir as a job and blocks until a worker has
+// built it, returning the name of the Builder used.
+func (p *buildPool) build(commit, dir string) (string, error) {
+	job := &buildJob{
+		commit: commit,
+		dir:    dir,
+		result: make(chan buildResult, 1),
+	}
+
+	p.jobs <- job
+	res := <-job.result
+	return res.builder, res.err
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 Tom Thorogood. All rights reserved.
+// Use of this source code is governed by a
+// Modified BSD License license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// repoWatcher periodically fetches ch's repo and refreshes the commit
+// index it serves, evicting any cached build whose commit has fallen
+// out of the refreshed history (for example after a force-push).
+type repoWatcher struct {
+	interval time.Duration
+	ch       *commitHandler
+}
+
+// run polls for new commits every interval until the process exits.
+func (rw *repoWatcher) run() {
+	ticker := time.NewTicker(rw.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := rw.refresh(); err != nil {
+			log.Printf("repoWatcher: refresh failed: %v", err)
+		}
+	}
+}
+
+// refresh fetches the repo and rebuilds the commit index, evicting
+// the cached build, host and live-reload handler of any commit that
+// is no longer present.
+func (rw *repoWatcher) refresh() error {
+	ch := rw.ch
+
+	ch.worktreeLock.Lock()
+	defer ch.worktreeLock.Unlock()
+
+	cmd := exec.Command("git", "fetch", "--all", "--prune")
+	cmd.Dir = ch.repoDir
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	cmd = exec.Command("git", "log", "--oneline", "@{upstream}")
+	cmd.Dir = ch.repoDir
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	var orderedCommits []string
+	commits := make(map[string]string)
+
+	scanner := bufio.NewScanner(&out)
+
+	for scanner.Scan() {
+		line := strings.SplitN(scanner.Text(), " ", 2)
+		commit, title := line[0], line[1]
+
+		orderedCommits = append(orderedCommits, commit)
+		commits[commit] = title
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	newIndex := newCommitIndex(orderedCommits, commits)
+
+	ch.mu.Lock()
+	oldIndex := ch.index
+	ch.index = newIndex
+	ch.mu.Unlock()
+
+	for _, c := range oldIndex.list {
+		if _, ok := newIndex.lookup(c.Hash); ok {
+			continue
+		}
+
+		ch.evict(c.Hash)
+	}
+
+	return nil
+}
+
+// evict removes any cached build, allocated host and live-reload
+// handler for commit, so that it will be rebuilt from scratch if it
+// is ever requested again.
+func (ch *commitHandler) evict(commit string) {
+	v, ok := ch.build.Load(commit)
+	if !ok {
+		ch.cache.remove(commit)
+		return
+	}
+
+	ch.build.Delete(commit)
+
+	if bc, ok := v.(*buildCommitOnce); ok && bc.host != "" {
+		ch.hosts.Remove(bc.host)
+	}
+
+	// Don't broadcast a live-reload here: nothing has rebuilt the
+	// commit yet, and the host mapping is already gone, so a reload
+	// now would just point connected browsers at a dead host. The
+	// next request will rebuild it and mount a fresh LiveReloadHandler.
+	ch.liveReload.Delete(commit)
+
+	ch.cache.remove(commit)
+}
+
+// refreshHandler triggers an immediate repoWatcher.refresh, verifying
+// an HMAC signature on the request body against secret first so that
+// push webhooks (GitHub, Gitea, ...) can drive a rebuild without
+// waiting for the next poll.
+type refreshHandler struct {
+	rw     *repoWatcher
+	secret string
+}
+
+func (rh *refreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !verifyWebhookSignature(rh.secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if err := rh.rw.refresh(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyWebhookSignature reports whether sig is a valid
+// "sha256=<hex>" HMAC-SHA256 signature of body under secret.
+func verifyWebhookSignature(secret string, body []byte, sig string) bool {
+	const prefix = "sha256="
+	if !strings.HasPrefix(sig, prefix) {
+		return false
+	}
+
+	want, err := hex.DecodeString(strings.TrimPrefix(sig, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(want, mac.Sum(nil))
+}